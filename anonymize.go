@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"strings"
+	"sync"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+var anonymize = flag.Bool("anonymize", false, "assign each client a random opaque nick and hide nicks/hostmasks from the network")
+
+// anonHost replaces every prefix's real host for an anonymized client, so
+// it never learns another user's true hostmask either.
+const anonHost = "anon.invalid"
+
+// anonCommands lists commands whose params carry nick targets, beyond
+// PRIVMSG/NOTICE/JOIN/PART: the same set sanitize already covers, plus
+// the query/target commands that can name a specific nick.
+var anonCommands = map[string]bool{
+	irc.NICK:    true,
+	irc.MODE:    true,
+	irc.SERVICE: true,
+	irc.INVITE: true,
+	"WHO":       true,
+	"WHOIS":     true,
+	"KICK":      true,
+	"TOPIC":     true,
+}
+
+// anonState tracks the real<->anonymous nick mapping for a single
+// serveConn invocation when -anonymize is set: the client keeps using
+// its real nick locally, while the upstream only ever sees the anonymous
+// one. Its fields are read and written from both proxy directions'
+// goroutines, so mu guards every access.
+type anonState struct {
+	mu       sync.Mutex
+	realNick string
+	anonNick string
+}
+
+func newAnonState() *anonState {
+	return &anonState{anonNick: randomAnonNick()}
+}
+
+// randomAnonNick uses crypto/rand rather than math/rand so that nicks
+// aren't predictable, and don't repeat across process restarts the way
+// an unseeded math/rand source would.
+func randomAnonNick() string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i, v := range b {
+		b[i] = letters[int(v)%len(letters)]
+	}
+	return "Anon" + string(b)
+}
+
+// toUpstreamFilter swaps the client's real nick for its anonymous one in
+// any outbound command that names a nick, issuing a fresh anonymous nick
+// whenever the client itself changes nick. It also rewrites the
+// username and realname carried in USER, so neither leaks upstream.
+func (a *anonState) toUpstreamFilter(dir Direction, msg *irc.Message) (*irc.Message, error) {
+	if dir != ClientToUpstream {
+		return msg, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if msg.Command == irc.NICK && len(msg.Params) > 0 {
+		if a.realNick != "" {
+			a.anonNick = randomAnonNick()
+		}
+		a.realNick = msg.Params[0]
+		msg.Params[0] = a.anonNick
+		return msg, nil
+	}
+
+	if msg.Command == irc.USER && len(msg.Params) > 0 {
+		msg.Params[0] = a.anonNick
+		if len(msg.Params) > 3 {
+			msg.Params[3] = a.anonNick
+		}
+		return msg, nil
+	}
+
+	if anonCommands[msg.Command] || msg.Command == irc.PRIVMSG || msg.Command == irc.NOTICE ||
+		msg.Command == irc.JOIN || msg.Command == irc.PART {
+		replaceParams(msg, a.realNick, a.anonNick)
+	}
+	return msg, nil
+}
+
+// fromUpstreamFilter swaps the anonymous nick back for the client's real
+// one wherever it appears, and strips every prefix's real host so the
+// client never sees another user's true hostmask.
+func (a *anonState) fromUpstreamFilter(dir Direction, msg *irc.Message) (*irc.Message, error) {
+	if dir != UpstreamToClient {
+		return msg, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if msg.Prefix != nil {
+		if msg.Prefix.Name == a.anonNick {
+			msg.Prefix.Name = a.realNick
+		}
+		if msg.Prefix.Host != "" {
+			msg.Prefix.Host = anonHost
+		}
+	}
+
+	if anonCommands[msg.Command] || msg.Command == irc.PRIVMSG || msg.Command == irc.NOTICE ||
+		msg.Command == irc.JOIN || msg.Command == irc.PART {
+		replaceParams(msg, a.anonNick, a.realNick)
+	}
+	return msg, nil
+}
+
+// replaceParams swaps every occurrence of from for to among msg's params,
+// including comma-separated lists (as used by e.g. JOIN/KICK/WHOIS).
+func replaceParams(msg *irc.Message, from, to string) {
+	if from == "" {
+		return
+	}
+	for i, p := range msg.Params {
+		parts := strings.Split(p, ",")
+		changed := false
+		for j, part := range parts {
+			if part == from {
+				parts[j] = to
+				changed = true
+			}
+		}
+		if changed {
+			msg.Params[i] = strings.Join(parts, ",")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Identity is a real upstream identity sharpy can authenticate as on a
+// client's behalf, once that client has proven who it is locally.
+type Identity struct {
+	SASLUser string `yaml:"sasl_user"`
+	SASLPass string `yaml:"sasl_pass"`
+}
+
+// Config is sharpy's optional YAML configuration. Loading one always
+// enables credential mapping: clients are mapped onto real upstream
+// credentials instead of connecting with their own. It is also the only
+// source of regex filter rules. Without a -config flag, sharpy proxies
+// connections with the clients' own credentials.
+type Config struct {
+	Upstream   string `yaml:"upstream"`
+	TLSCA      string `yaml:"tls_ca"`
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+
+	// Users maps a local PASS sent by a client to the upstream identity
+	// sharpy should authenticate as on its behalf.
+	Users map[string]Identity `yaml:"users"`
+
+	// Filters is an ordered list of regex rules applied to PRIVMSG/NOTICE
+	// text by regexFilter. A rule with no Replace drops matching
+	// messages outright; otherwise the match is substituted.
+	Filters []FilterRule `yaml:"filters"`
+}
+
+// FilterRule is one entry of Config.Filters.
+type FilterRule struct {
+	Pattern string  `yaml:"pattern"`
+	Replace *string `yaml:"replace"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %q: %v", path, err)
+	}
+	return &cfg, nil
+}
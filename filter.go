@@ -0,0 +1,237 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Direction identifies which way a message is flowing through the
+// filter chain.
+type Direction int
+
+const (
+	ClientToUpstream Direction = iota
+	UpstreamToClient
+)
+
+// Filter is one stage of the filter chain proxy runs every message
+// through. It may mutate msg in place, replace it by returning a
+// different *irc.Message, or drop it by returning a nil message and nil
+// error. A non-nil error aborts the connection.
+type Filter interface {
+	Apply(dir Direction, msg *irc.Message) (*irc.Message, error)
+}
+
+// FilterFunc adapts a plain function to the Filter interface.
+type FilterFunc func(dir Direction, msg *irc.Message) (*irc.Message, error)
+
+func (f FilterFunc) Apply(dir Direction, msg *irc.Message) (*irc.Message, error) {
+	return f(dir, msg)
+}
+
+// defaultFilters is the ordered chain proxy runs every message through.
+// It generalizes the old flat per-command sanitize map: truncation, nick
+// and CAP sanitization, formatting/CTCP scrubbing and user-configured
+// regex rules are all just stages, so new ones can be added here without
+// touching proxy itself.
+var defaultFilters = []Filter{
+	FilterFunc(legacyFilter),
+	FilterFunc(stripFormattingFilter),
+	FilterFunc(ctcpFilter),
+	FilterFunc(regexFilter),
+}
+
+// runFilters passes msg through chain in order, stopping as soon as a
+// filter drops it (returns a nil message) or errors.
+func runFilters(chain []Filter, dir Direction, msg *irc.Message) (*irc.Message, error) {
+	var err error
+	for _, f := range chain {
+		msg, err = f.Apply(dir, msg)
+		if err != nil || msg == nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+type sanitizeFunc func(*irc.Message) error
+
+var sanitize = map[string]sanitizeFunc{
+	irc.NICK: sanitizeFirstArg(sanitizeNick),
+	irc.MODE: sanitizeFirstArg(sanitizeNick),
+	irc.SERVICE: sanitizeFirstArg(sanitizeNick),
+	irc.INVITE: sanitizeFirstArg(sanitizeNick),
+	irc.PRIVMSG: sanitizeMessage,
+	irc.NOTICE: sanitizeMessage,
+}
+
+const cmdCAP = "CAP"
+
+// allowedCaps is the set of IRCv3 capabilities sharpy is willing to
+// negotiate on behalf of a client. Anything else is stripped from the
+// upstream's CAP LS/NEW reply and never let through in a client's CAP REQ,
+// so neither side can end up agreeing on a capability the other wasn't
+// told about.
+//
+// Tag-bearing capabilities (message-tags, server-time, account-tag, ...)
+// are deliberately left out: tagFilterConn (tags.go) strips every IRCv3
+// tag off the wire in both directions, so negotiating one of those caps
+// would let a client believe it's getting tags it will never receive.
+var allowedCaps = map[string]bool{
+	"echo-message": true,
+	"sasl":         true,
+}
+
+// sanitizeCapList filters the space-separated capability list carried in
+// the last parameter of a CAP LS/NEW/REQ message against allowedCaps,
+// preserving any "=value" suffix (e.g. "sasl=PLAIN,EXTERNAL").
+func sanitizeCapList(msg *irc.Message) {
+	if len(msg.Params) == 0 {
+		return
+	}
+	last := len(msg.Params) - 1
+	caps := strings.Fields(msg.Params[last])
+	kept := caps[:0]
+	for _, c := range caps {
+		name := c
+		if i := strings.IndexByte(c, '='); i >= 0 {
+			name = c[:i]
+		}
+		if allowedCaps[name] {
+			kept = append(kept, c)
+		}
+	}
+	msg.Params[last] = strings.Join(kept, " ")
+}
+
+// sanitizeCap mediates CAP negotiation between client and upstream: the
+// upstream's advertised capability list is trimmed down to allowedCaps
+// before it reaches the client, and a client's CAP REQ is trimmed the same
+// way before it reaches the upstream, so the two sides never negotiate a
+// capability sharpy doesn't know how to proxy.
+func sanitizeCap(toUpstream bool) sanitizeFunc {
+	return func(msg *irc.Message) error {
+		// A client's own CAP command has the subcommand as Params[0]
+		// ("CAP REQ :..."), but a server's CAP reply carries a target
+		// (usually "*") first ("CAP * LS :..."), pushing the
+		// subcommand to Params[1].
+		idx := 0
+		if !toUpstream {
+			idx = 1
+		}
+		if len(msg.Params) <= idx {
+			return errNotEnoughParams
+		}
+		switch sub := strings.ToUpper(msg.Params[idx]); {
+		case sub == "LS" || sub == "NEW":
+			if !toUpstream {
+				sanitizeCapList(msg)
+			}
+		case sub == "REQ":
+			if toUpstream {
+				sanitizeCapList(msg)
+			}
+		}
+		return nil
+	}
+}
+
+func sanitizeFirstArg(sanitize func(string) string) sanitizeFunc {
+	return func(msg *irc.Message) error {
+		if len(msg.Params) == 0 {
+			return errNotEnoughParams
+		}
+		msg.Params[0] = sanitize(msg.Params[0])
+		return nil
+	}
+}
+
+func sanitizeMessage(msg *irc.Message) error {
+	if len(msg.Params) < 2 {
+		return errNotEnoughParams
+	}
+	if len(msg.Params[1]) > 512 {
+		// TODO: this doesn't comply with the RFC, but it's better than nothing
+		msg.Params[1] = msg.Params[1][:512]
+	}
+	return nil
+}
+
+// ( letter / special ) *8( letter / digit / special / "-" )
+func sanitizeNick(nick string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		switch r {
+		// %x5B-60 / %x7B-7D
+		// ; "[", "]", "\", "`", "_", "^", "{", "|", "}"
+		case '-', '[', ']', '\\', '`', '_', '^', '{', '|', '}':
+			return r
+		}
+		return '_'
+	}, nick)
+}
+
+// legacyFilter is the original per-command sanitization (nick charset,
+// 512-byte truncation) plus CAP mediation, adapted to the Filter chain.
+func legacyFilter(dir Direction, msg *irc.Message) (*irc.Message, error) {
+	if msg.Command == cmdCAP {
+		if err := sanitizeCap(dir == ClientToUpstream)(msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+
+	if f, ok := sanitize[msg.Command]; ok {
+		if err := f(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// regexRules holds the compiled -config `filters:` rules, rebuilt once at
+// startup by compileFilterRules. Messages matching a drop rule are
+// dropped outright; matches of a replace rule have the match substituted.
+var regexRules []compiledFilterRule
+
+type compiledFilterRule struct {
+	re      *regexp.Regexp
+	replace *string
+}
+
+func compileFilterRules(rules []FilterRule) ([]compiledFilterRule, error) {
+	compiled := make([]compiledFilterRule, 0, len(rules))
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, compiledFilterRule{re: re, replace: r.Replace})
+	}
+	return compiled, nil
+}
+
+// regexFilter applies the user-configured regexRules to PRIVMSG/NOTICE
+// text, in order: a rule with no replacement drops the message on match,
+// otherwise the match is substituted.
+func regexFilter(dir Direction, msg *irc.Message) (*irc.Message, error) {
+	if len(regexRules) == 0 || (msg.Command != irc.PRIVMSG && msg.Command != irc.NOTICE) || len(msg.Params) < 2 {
+		return msg, nil
+	}
+
+	for _, rule := range regexRules {
+		if rule.replace == nil {
+			if rule.re.MatchString(msg.Params[1]) {
+				return nil, nil
+			}
+			continue
+		}
+		msg.Params[1] = rule.re.ReplaceAllString(msg.Params[1], *rule.replace)
+	}
+	return msg, nil
+}
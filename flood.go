@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+var (
+	floodMsgsPerSec  = flag.Float64("flood-msgs-per-sec", 0, "max client->upstream messages per second, 0 to disable")
+	floodBurst       = flag.Int("flood-burst", 5, "burst size for -flood-msgs-per-sec")
+	floodChatPerSec  = flag.Float64("flood-chat-msgs-per-sec", 0, "max client->upstream PRIVMSG/NOTICE per second, 0 to disable")
+	floodChatBurst   = flag.Int("flood-chat-burst", 5, "burst size for -flood-chat-msgs-per-sec")
+	floodBytesPerSec = flag.Float64("flood-bytes-per-sec", 0, "max client->upstream bytes per second, 0 to disable")
+	floodBytesBurst  = flag.Float64("flood-bytes-burst", 4096, "burst size in bytes for -flood-bytes-per-sec; should stay above the longest IRC line (512 bytes)")
+	floodQueue       = flag.Bool("flood-queue", false, "queue messages exceeding the flood limit instead of dropping them")
+)
+
+// tokenBucket is a minimal token-bucket rate limiter: it refills at
+// ratePerSec tokens per second up to burst tokens.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func newTokenBucket(ratePerSec float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: ratePerSec, burst: burst, tokens: burst, lastFill: time.Now()}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.lastFill).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastFill = now
+}
+
+// Allow takes n tokens if available and reports whether it could. n is
+// capped to burst first, so a single request larger than the bucket's
+// whole burst is throttled rather than dropped on every attempt forever.
+func (b *tokenBucket) Allow(n float64) bool {
+	if n > b.burst {
+		n = b.burst
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Wait blocks until n tokens are available, then takes them. n is capped
+// to burst first: a single request larger than the bucket's whole burst
+// could otherwise never accumulate enough tokens and wait forever.
+func (b *tokenBucket) Wait(n float64) {
+	if n > b.burst {
+		n = b.burst
+	}
+	for {
+		b.mu.Lock()
+		b.refill()
+		if b.tokens >= n {
+			b.tokens -= n
+			b.mu.Unlock()
+			return
+		}
+		missing := n - b.tokens
+		b.mu.Unlock()
+		time.Sleep(time.Duration(missing / b.rate * float64(time.Second)))
+	}
+}
+
+// floodController enforces the -flood-* limits on the client->upstream
+// direction of a single connection, with PRIVMSG/NOTICE metered
+// separately from other commands since they're the usual flood vector.
+type floodController struct {
+	msgs  *tokenBucket
+	chat  *tokenBucket
+	bytes *tokenBucket
+}
+
+func newFloodController() *floodController {
+	fc := &floodController{}
+	if *floodMsgsPerSec > 0 {
+		fc.msgs = newTokenBucket(*floodMsgsPerSec, float64(*floodBurst))
+	}
+	if *floodChatPerSec > 0 {
+		fc.chat = newTokenBucket(*floodChatPerSec, float64(*floodChatBurst))
+	}
+	if *floodBytesPerSec > 0 {
+		fc.bytes = newTokenBucket(*floodBytesPerSec, *floodBytesBurst)
+	}
+	return fc
+}
+
+// messageSize estimates the wire size of msg for the byte/sec bucket.
+func messageSize(msg *irc.Message) float64 {
+	size := float64(len(msg.Command))
+	for _, p := range msg.Params {
+		size += float64(len(p)) + 1
+	}
+	return size
+}
+
+// Allow applies the flood limits to msg. It reports false if the message
+// should be dropped. With -flood-queue set, it instead blocks until the
+// message may be forwarded and always returns true.
+func (fc *floodController) Allow(msg *irc.Message) bool {
+	bucket := fc.msgs
+	if msg.Command == irc.PRIVMSG || msg.Command == irc.NOTICE {
+		bucket = fc.chat
+	}
+	size := messageSize(msg)
+
+	if *floodQueue {
+		if bucket != nil {
+			bucket.Wait(1)
+		}
+		if fc.bytes != nil {
+			fc.bytes.Wait(size)
+		}
+		return true
+	}
+
+	if bucket != nil && !bucket.Allow(1) {
+		return false
+	}
+	if fc.bytes != nil && !fc.bytes.Allow(size) {
+		return false
+	}
+	return true
+}
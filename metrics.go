@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+var metricsAddr = flag.String("metrics-addr", "", "if set, serve Prometheus metrics for flood/forwarding counters on this address")
+
+var (
+	messagesForwarded uint64
+	messagesDropped   uint64
+	bytesForwarded    uint64
+)
+
+// serveMetrics exposes the forwarding/flood counters in Prometheus text
+// exposition format. It's meant to run for the lifetime of the process;
+// callers start it in its own goroutine.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# HELP sharpy_messages_forwarded_total Messages forwarded client->upstream.\n")
+		fmt.Fprintf(w, "# TYPE sharpy_messages_forwarded_total counter\n")
+		fmt.Fprintf(w, "sharpy_messages_forwarded_total %d\n", atomic.LoadUint64(&messagesForwarded))
+
+		fmt.Fprintf(w, "# HELP sharpy_messages_dropped_total Messages dropped by the flood controller.\n")
+		fmt.Fprintf(w, "# TYPE sharpy_messages_dropped_total counter\n")
+		fmt.Fprintf(w, "sharpy_messages_dropped_total %d\n", atomic.LoadUint64(&messagesDropped))
+
+		fmt.Fprintf(w, "# HELP sharpy_bytes_forwarded_total Bytes forwarded client->upstream.\n")
+		fmt.Fprintf(w, "# TYPE sharpy_bytes_forwarded_total counter\n")
+		fmt.Fprintf(w, "sharpy_bytes_forwarded_total %d\n", atomic.LoadUint64(&bytesForwarded))
+	})
+	log.Println("Serving metrics on", addr)
+	log.Println(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// authChunkSize is the maximum length of a single AUTHENTICATE parameter,
+// per the SASL IRCv3 spec; longer payloads are split across several
+// AUTHENTICATE lines. A lone "+" follows only when the last chunk is
+// exactly authChunkSize long (or the payload is empty), marking the end.
+const authChunkSize = 400
+
+// negotiateClientAuth reads a client's registration messages up to and
+// including USER, resolving the identity it should be logged into
+// upstream as. PASS is never forwarded: it only selects an entry in
+// cfg.Users. The buffered NICK/USER (and anything else sent meanwhile)
+// are returned for replay against the upstream once it's authenticated.
+func negotiateClientAuth(dec *irc.Decoder, enc *irc.Encoder) (Identity, []*irc.Message, error) {
+	var pass string
+	var buffered []*irc.Message
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			return Identity{}, nil, err
+		}
+
+		if msg.Command == irc.PASS {
+			if len(msg.Params) > 0 {
+				pass = msg.Params[0]
+			}
+			continue
+		}
+
+		buffered = append(buffered, msg)
+		if msg.Command != irc.USER {
+			continue
+		}
+
+		identity, ok := cfg.Users[pass]
+		if !ok {
+			enc.Encode(&irc.Message{Command: irc.ERROR, Params: []string{"Closing Link: invalid password"}})
+			return Identity{}, nil, fmt.Errorf("no identity configured for supplied password")
+		}
+		return identity, buffered, nil
+	}
+}
+
+// authenticateSASL performs a SASL PLAIN handshake with the upstream as
+// identity, requesting the sasl capability and driving AUTHENTICATE to
+// completion. It leaves the upstream connection mid-registration, ready
+// for the client's buffered NICK/USER to be replayed and CAP END sent.
+func authenticateSASL(dec *irc.Decoder, enc *irc.Encoder, identity Identity) error {
+	if err := enc.Encode(&irc.Message{Command: cmdCAP, Params: []string{"REQ", "sasl"}}); err != nil {
+		return err
+	}
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			return err
+		}
+		if msg.Command != cmdCAP || len(msg.Params) < 2 {
+			continue
+		}
+		switch msg.Params[1] {
+		case "ACK":
+			return authenticatePlain(dec, enc, identity)
+		case "NAK":
+			return fmt.Errorf("upstream refused sasl capability")
+		}
+	}
+}
+
+func authenticatePlain(dec *irc.Decoder, enc *irc.Encoder, identity Identity) error {
+	if err := enc.Encode(&irc.Message{Command: "AUTHENTICATE", Params: []string{"PLAIN"}}); err != nil {
+		return err
+	}
+	if _, err := dec.Decode(); err != nil { // AUTHENTICATE +
+		return err
+	}
+
+	payload := []byte(identity.SASLUser + "\x00" + identity.SASLUser + "\x00" + identity.SASLPass)
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	for i := 0; i < len(encoded); i += authChunkSize {
+		end := i + authChunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		if err := enc.Encode(&irc.Message{Command: "AUTHENTICATE", Params: []string{encoded[i:end]}}); err != nil {
+			return err
+		}
+	}
+	if len(encoded)%authChunkSize == 0 {
+		if err := enc.Encode(&irc.Message{Command: "AUTHENTICATE", Params: []string{"+"}}); err != nil {
+			return err
+		}
+	}
+
+	// Real ircds send interim numerics (e.g. 900 RPL_LOGGEDIN) before the
+	// one that actually concludes SASL; keep reading until we see one of
+	// those instead of bailing out on the first reply.
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			return err
+		}
+		switch msg.Command {
+		case "903": // RPL_SASLSUCCESS
+			return nil
+		case "904", "905", "906": // ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+			return fmt.Errorf("sasl authentication failed: %v", msg)
+		}
+	}
+}
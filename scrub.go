@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"regexp"
+	"strings"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+var stripFormatting = flag.Bool("strip-formatting", false, "strip mIRC color/bold/italic/underline/reverse codes from PRIVMSG/NOTICE text")
+var filterCTCP = flag.Bool("filter-ctcp", false, "drop CTCP requests/replies other than ACTION and VERSION")
+
+const (
+	ctrlBold      = '\x02'
+	ctrlColor     = '\x03'
+	ctrlItalic    = '\x1D'
+	ctrlUnderline = '\x1F'
+	ctrlReverse   = '\x16'
+	ctrlReset     = '\x0F'
+	ctcpDelim     = '\x01'
+)
+
+var mircColorRe = regexp.MustCompile(`\x03(\d{1,2}(,\d{1,2})?)?`)
+
+// stripFormattingFilter removes mIRC formatting codes from PRIVMSG/NOTICE
+// text when -strip-formatting is set: color codes (with their optional
+// foreground,background digits) and the bold/italic/underline/reverse/
+// reset control characters.
+func stripFormattingFilter(dir Direction, msg *irc.Message) (*irc.Message, error) {
+	if !*stripFormatting || (msg.Command != irc.PRIVMSG && msg.Command != irc.NOTICE) || len(msg.Params) < 2 {
+		return msg, nil
+	}
+	msg.Params[1] = stripFormattingCodes(msg.Params[1])
+	return msg, nil
+}
+
+func stripFormattingCodes(s string) string {
+	s = mircColorRe.ReplaceAllString(s, "")
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ctrlBold, ctrlItalic, ctrlUnderline, ctrlReverse, ctrlReset:
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// allowedCTCP is the set of CTCP commands sharpy lets through unchanged.
+// Anything else (PING, TIME, DCC, ...) is a common source of information
+// disclosure or abuse, so the whole message is dropped.
+var allowedCTCP = map[string]bool{
+	"ACTION":  true,
+	"VERSION": true,
+}
+
+// ctcpFilter drops CTCP requests/replies (PRIVMSG/NOTICE text wrapped in
+// \x01) whose command isn't in allowedCTCP, when -filter-ctcp is set. It
+// defaults to off since it otherwise breaks DCC and any CTCP besides
+// ACTION/VERSION for every user, not just those who asked for it.
+func ctcpFilter(dir Direction, msg *irc.Message) (*irc.Message, error) {
+	if !*filterCTCP {
+		return msg, nil
+	}
+	if msg.Command != irc.PRIVMSG && msg.Command != irc.NOTICE {
+		return msg, nil
+	}
+	if len(msg.Params) < 2 {
+		return msg, nil
+	}
+
+	text := msg.Params[1]
+	if len(text) < 2 || text[0] != ctcpDelim || text[len(text)-1] != ctcpDelim {
+		return msg, nil
+	}
+
+	inner := text[1 : len(text)-1]
+	command := inner
+	if i := strings.IndexByte(inner, ' '); i >= 0 {
+		command = inner[:i]
+	}
+	if !allowedCTCP[strings.ToUpper(command)] {
+		return nil, nil
+	}
+	return msg, nil
+}
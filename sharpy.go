@@ -6,65 +6,21 @@ import (
 	"flag"
 	"log"
 	"net"
-	"strings"
-	"unicode"
+	"sync/atomic"
 
 	"gopkg.in/sorcix/irc.v2"
 )
 
 var upstreamAddr string
 
-var errNotEnoughParams = errors.New("not enough parameters")
-
-type sanitizeFunc func(*irc.Message) error
-
-var sanitize = map[string]sanitizeFunc{
-	irc.NICK: sanitizeFirstArg(sanitizeNick),
-	irc.MODE: sanitizeFirstArg(sanitizeNick),
-	irc.SERVICE: sanitizeFirstArg(sanitizeNick),
-	irc.INVITE: sanitizeFirstArg(sanitizeNick),
-	irc.PRIVMSG: sanitizeMessage,
-	irc.NOTICE: sanitizeMessage,
-}
-
-func sanitizeFirstArg(sanitize func(string) string) sanitizeFunc {
-	return func(msg *irc.Message) error {
-		if len(msg.Params) == 0 {
-			return errNotEnoughParams
-		}
-		msg.Params[0] = sanitize(msg.Params[0])
-		return nil
-	}
-}
-
-func sanitizeMessage(msg *irc.Message) error {
-	if len(msg.Params) < 2 {
-		return errNotEnoughParams
-	}
-	if len(msg.Params[1]) > 512 {
-		// TODO: this doesn't comply with the RFC, but it's better than nothing
-		msg.Params[1] = msg.Params[1][:512]
-	}
-	return nil
-}
+// cfg is non-nil when sharpy was started with -config, which enables
+// credential mapping: clients authenticate locally and are logged into
+// upstream under a stored identity instead of their own.
+var cfg *Config
 
-// ( letter / special ) *8( letter / digit / special / "-" )
-func sanitizeNick(nick string) string {
-	return strings.Map(func(r rune) rune {
-		if unicode.IsLetter(r) || unicode.IsDigit(r) {
-			return r
-		}
-		switch r {
-		// %x5B-60 / %x7B-7D
-		// ; "[", "]", "\", "`", "_", "^", "{", "|", "}"
-	case '-', '[', ']', '\\', '`', '_', '^', '{', '|', '}':
-			return r
-		}
-		return '_'
-	}, nick)
-}
+var errNotEnoughParams = errors.New("not enough parameters")
 
-func proxy(dec *irc.Decoder, enc *irc.Encoder) error {
+func proxy(dec *irc.Decoder, enc *irc.Encoder, dir Direction, fc *floodController, filters []Filter) error {
 	for {
 		msg, err := dec.Decode()
 		if err != nil {
@@ -75,46 +31,136 @@ func proxy(dec *irc.Decoder, enc *irc.Encoder) error {
 			msg.Prefix.User = sanitizeNick(msg.Prefix.User)
 		}
 
-		if f, ok := sanitize[msg.Command]; ok {
-			if err := f(msg); err != nil {
-				return err
-			}
+		msg, err = runFilters(filters, dir, msg)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+
+		if fc != nil && !fc.Allow(msg) {
+			atomic.AddUint64(&messagesDropped, 1)
+			continue
 		}
 
 		if err := enc.Encode(msg); err != nil {
 			return err
 		}
+
+		if fc != nil {
+			atomic.AddUint64(&messagesForwarded, 1)
+			atomic.AddUint64(&bytesForwarded, uint64(messageSize(msg)))
+		}
 	}
 }
 
-func serveConn(conn *irc.Conn) error {
-	defer conn.Close()
+func serveConn(rawConn net.Conn) error {
+	client := irc.NewConn(newTagFilterConn(rawConn))
+	defer client.Close()
 
-	upstream, err := irc.DialTLS(upstreamAddr, &tls.Config{InsecureSkipVerify: true})
+	var identity Identity
+	var buffered []*irc.Message
+	if cfg != nil {
+		var err error
+		identity, buffered, err = negotiateClientAuth(&client.Decoder, &client.Encoder)
+		if err != nil {
+			return err
+		}
+	}
+
+	tlsConfig, err := upstreamTLSConfig()
+	if err != nil {
+		return err
+	}
+	rawUpstream, err := tls.Dial("tcp", upstreamAddr, tlsConfig)
 	if err != nil {
 		return err
 	}
+	upstream := irc.NewConn(newTagFilterConn(rawUpstream))
 	defer upstream.Close()
 
+	filters := defaultFilters
+	if *anonymize {
+		anon := newAnonState()
+		filters = append(append([]Filter{}, defaultFilters...), FilterFunc(anon.toUpstreamFilter), FilterFunc(anon.fromUpstreamFilter))
+	}
+
+	if cfg != nil {
+		if err := authenticateSASL(&upstream.Decoder, &upstream.Encoder, identity); err != nil {
+			return err
+		}
+		for _, msg := range buffered {
+			msg, err := runFilters(filters, ClientToUpstream, msg)
+			if err != nil {
+				return err
+			}
+			if msg == nil {
+				continue
+			}
+			if err := upstream.Encoder.Encode(msg); err != nil {
+				return err
+			}
+		}
+		if err := upstream.Encoder.Encode(&irc.Message{Command: cmdCAP, Params: []string{"END"}}); err != nil {
+			return err
+		}
+	}
+
+	fc := newFloodController()
+
 	done := make(chan error, 2)
 	go func() {
-		done <- proxy(&conn.Decoder, &upstream.Encoder)
+		done <- proxy(&client.Decoder, &upstream.Encoder, ClientToUpstream, fc, filters)
 	}()
 	go func() {
-		done <- proxy(&upstream.Decoder, &conn.Encoder)
+		done <- proxy(&upstream.Decoder, &client.Encoder, UpstreamToClient, nil, filters)
 	}()
 	return <-done
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to a YAML config enabling upstream credential mapping")
 	flag.Parse()
-	if upstreamAddr = flag.Arg(0); upstreamAddr == "" {
+	upstreamAddr = flag.Arg(0)
+
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+		if regexRules, err = compileFilterRules(cfg.Filters); err != nil {
+			log.Fatal(err)
+		}
+		if upstreamAddr == "" {
+			upstreamAddr = cfg.Upstream
+		}
+	}
+
+	if upstreamAddr == "" {
 		log.Fatal("no upstream specified")
 	}
 
-	l, err := net.Listen("tcp", ":6667")
-	if err != nil {
-		log.Fatal(err)
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	var l net.Listener
+	if *listenTLS {
+		lCfg, err := listenTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err = tls.Listen("tcp", ":6697", lCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		var err error
+		l, err = net.Listen("tcp", ":6667")
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 	defer l.Close()
 
@@ -127,7 +173,7 @@ func main() {
 		}
 
 		go func() {
-			err := serveConn(irc.NewConn(conn))
+			err := serveConn(conn)
 			if err != nil {
 				log.Println(err)
 			}
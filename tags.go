@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+)
+
+// stripTagLine removes the IRCv3 message-tag prefix from a raw
+// (CR/LF-free) IRC line, if present.
+//
+// gopkg.in/sorcix/irc.v2 predates the message-tags spec: it has no
+// notion of tags, and handing it a tagged line doesn't just lose the
+// tags, it corrupts the parse. ParseMessage treats the whole "@key=val
+// ... " blob as the command and uppercases it in the process, so a
+// client can evade every command-keyed stage of the pipeline (sanitize,
+// flood control, the filter chain, anonymization) just by prefixing an
+// arbitrary tag. So tags are dropped outright here, on the raw wire,
+// before a line ever reaches irc.Decoder — there is no way to sanitize
+// and keep them without that corruption.
+func stripTagLine(line string) string {
+	if !strings.HasPrefix(line, "@") {
+		return line
+	}
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[i+1:]
+	}
+	return ""
+}
+
+// tagFilterConn wraps a net.Conn and strips the IRCv3 message-tag prefix
+// of every line read from it, line by line, before the data reaches
+// irc.Decoder.
+type tagFilterConn struct {
+	net.Conn
+	buf bytes.Buffer
+	br  *bufio.Reader
+}
+
+func newTagFilterConn(conn net.Conn) *tagFilterConn {
+	return &tagFilterConn{Conn: conn, br: bufio.NewReader(conn)}
+}
+
+func (c *tagFilterConn) Read(p []byte) (int, error) {
+	for c.buf.Len() == 0 {
+		line, err := c.br.ReadString('\n')
+		if trimmed := strings.TrimRight(line, "\r\n"); trimmed != "" {
+			if stripped := stripTagLine(trimmed); stripped != "" {
+				c.buf.WriteString(stripped)
+				c.buf.WriteString("\r\n")
+			}
+		}
+		if err != nil {
+			if c.buf.Len() == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	return c.buf.Read(p)
+}
+
+var _ io.Reader = (*tagFilterConn)(nil)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	upstreamCA         = flag.String("upstream-ca", "", "PEM file of CA certificates to verify the upstream's certificate against")
+	upstreamServerName = flag.String("upstream-servername", "", "SNI / certificate servername to use when dialing upstream (defaults to the upstream host)")
+	upstreamCert       = flag.String("upstream-cert", "", "client certificate to present to upstream, e.g. for CertFP authentication")
+	upstreamKey        = flag.String("upstream-key", "", "private key matching -upstream-cert")
+	insecure           = flag.Bool("insecure", false, "do not verify the upstream's certificate (unsafe, for testing only)")
+
+	listenTLS         = flag.Bool("listen-tls", false, "terminate TLS from clients instead of listening in plaintext")
+	listenCert        = flag.String("listen-cert", "", "certificate to present to clients, required with -listen-tls")
+	listenKey         = flag.String("listen-key", "", "private key matching -listen-cert")
+	requireClientCert = flag.Bool("listen-require-client-cert", false, "require clients to present a certificate when using -listen-tls")
+)
+
+// upstreamTLSConfig builds the tls.Config used to dial the upstream from
+// the -upstream-* and -insecure flags, falling back to the tls_ca/
+// client_cert/client_key fields of -config when the matching flag
+// wasn't given. Verification is on by default; InsecureSkipVerify is
+// only ever set by the explicit -insecure opt-in.
+func upstreamTLSConfig() (*tls.Config, error) {
+	ca, cert, key := *upstreamCA, *upstreamCert, *upstreamKey
+	if cfg != nil {
+		if ca == "" {
+			ca = cfg.TLSCA
+		}
+		if cert == "" {
+			cert = cfg.ClientCert
+		}
+		if key == "" {
+			key = cfg.ClientKey
+		}
+	}
+
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: *insecure,
+		ServerName:         *upstreamServerName,
+	}
+
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", ca)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cert != "" {
+		keyPair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{keyPair}
+	}
+
+	return tlsCfg, nil
+}
+
+// listenTLSConfig builds the tls.Config sharpy terminates client
+// connections with when -listen-tls is set.
+func listenTLSConfig() (*tls.Config, error) {
+	if *listenCert == "" || *listenKey == "" {
+		return nil, fmt.Errorf("-listen-tls requires -listen-cert and -listen-key")
+	}
+	cert, err := tls.LoadX509KeyPair(*listenCert, *listenKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *requireClientCert {
+		tlsCfg.ClientAuth = tls.RequireAnyClientCert
+	}
+	return tlsCfg, nil
+}